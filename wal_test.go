@@ -1,14 +1,17 @@
 package tsdb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/coreos/etcd/pkg/fileutil"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/stretchr/testify/require"
 )
 
@@ -79,7 +82,7 @@ func TestWAL_cut(t *testing.T) {
 	defer os.RemoveAll(tmpdir)
 
 	// This calls cut() implicitly the first time without a previous tail.
-	w, err := OpenWAL(tmpdir, nil, 0)
+	w, err := OpenWAL(tmpdir, nil, 0, nil)
 	require.NoError(t, err)
 
 	require.NoError(t, w.entry(WALEntrySeries, 1, []byte("Hello World!!")))
@@ -115,6 +118,243 @@ func TestWAL_cut(t *testing.T) {
 	}
 }
 
+// Corrupting a record's payload must be caught by its checksum when the
+// WAL is replayed.
+func TestWAL_CorruptedRecord(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_corrupted_record")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, w.entry(WALEntrySeries, 1, []byte("Hello World!!")))
+	require.NoError(t, w.Close())
+
+	fn := w.files[0].Name()
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	// Flip a byte inside the payload, which starts right after the
+	// 8 byte segment header and the 6 byte record header.
+	_, err = f.WriteAt([]byte{'h'}, 8+6)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+
+	r := w.Reader()
+	require.False(t, r.Next())
+	cerr, ok := r.Err().(*CorruptionError)
+	require.True(t, ok, "expected a *CorruptionError, got %v", r.Err())
+	require.Equal(t, 0, cerr.Segment)
+	require.Equal(t, int64(8), cerr.Offset)
+}
+
+// RepairOnOpen truncates a segment at its first corrupted record and
+// moves the remaining bytes into a corrupted-* sidecar.
+func TestWAL_RepairOnOpen(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_repair_on_open")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+
+	series1 := []labels.Labels{{{Name: "a", Value: "1"}}}
+	series2 := []labels.Labels{{{Name: "a", Value: "2"}}}
+	require.NoError(t, w.Log(series1, nil))
+	require.NoError(t, w.Log(series2, nil))
+	require.NoError(t, w.Close())
+
+	buf1, err := encodeSeries(series1)
+	require.NoError(t, err)
+	rec1Size := 8 + recordFrameSize(len(buf1), false)
+
+	fn := w.files[0].Name()
+	// Corrupt a payload byte of the second record so that its checksum
+	// no longer matches, leaving the first one intact.
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0}, rec1Size+6+3)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = OpenWAL(tmpdir, nil, 0, &WALOptions{RepairOnOpen: true})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	fi, err := os.Stat(fn)
+	require.NoError(t, err)
+	require.Equal(t, rec1Size, fi.Size(), "segment should be truncated before the corrupted record")
+
+	sidecar := fmt.Sprintf("%s/corrupted-00000000-%d", tmpdir, rec1Size)
+	_, err = os.Stat(sidecar)
+	require.NoError(t, err, "expected a corrupted sidecar file")
+}
+
+// Tail must deliver records as they are logged and keep delivering
+// across a segment rollover, then close its channel once ctx is
+// cancelled.
+func TestWAL_TailRollover(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_tail_rollover")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch, err := w.Tail(ctx, WALPosition{Segment: 0, Offset: 8})
+	require.NoError(t, err)
+
+	series1 := []labels.Labels{{{Name: "a", Value: "1"}}}
+	require.NoError(t, w.Log(series1, nil))
+
+	select {
+	case rec := <-ch:
+		require.Equal(t, series1, rec.Series)
+		require.Equal(t, uint64(0), rec.Position.Segment)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record from the active segment")
+	}
+
+	require.NoError(t, w.cut())
+
+	series2 := []labels.Labels{{{Name: "a", Value: "2"}}}
+	require.NoError(t, w.Log(series2, nil))
+
+	select {
+	case rec := <-ch:
+		require.Equal(t, series2, rec.Series)
+		require.Equal(t, uint64(1), rec.Position.Segment, "tail should have rolled into the new segment")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for record after rollover")
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		require.False(t, ok, "channel should be closed once ctx is cancelled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for channel to close")
+	}
+
+	require.NoError(t, w.Close())
+}
+
+// Tail must be resumable from the WALPosition of a previously read
+// record rather than only from the start of the WAL.
+func TestWAL_TailResume(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_tail_resume")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+
+	series1 := []labels.Labels{{{Name: "a", Value: "1"}}}
+	series2 := []labels.Labels{{{Name: "a", Value: "2"}}}
+	require.NoError(t, w.Log(series1, nil))
+	require.NoError(t, w.Log(series2, nil))
+
+	buf1, err := encodeSeries(series1)
+	require.NoError(t, err)
+	resumeFrom := WALPosition{Segment: 0, Offset: 8 + recordFrameSize(len(buf1), false)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := w.Tail(ctx, resumeFrom)
+	require.NoError(t, err)
+
+	select {
+	case rec := <-ch:
+		require.Equal(t, series2, rec.Series, "tail should resume right after series1, at series2")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resumed record")
+	}
+
+	require.NoError(t, w.Close())
+}
+
+// Appending past MaxSegmentSize must roll over into a new segment
+// automatically, without an explicit cut().
+func TestWAL_MaxSegmentSizeRotation(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_max_segment_size")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, &WALOptions{MaxSegmentSize: 64})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.entry(WALEntrySeries, 1, []byte("0123456789")))
+	}
+	require.NoError(t, w.Close())
+
+	require.True(t, len(w.files) > 1, "expected MaxSegmentSize to trigger at least one rotation, got %d segment(s)", len(w.files))
+}
+
+// The janitor must reclaim sealed segments once MaxTotalSize is
+// exceeded even if no consumer ever calls Truncate, and must never
+// delete at or past a watermark one has registered.
+func TestWAL_Retention(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_retention")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, &WALOptions{MaxSegmentSize: 64, MaxTotalSize: 50})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.entry(WALEntrySeries, 1, []byte("0123456789")))
+	}
+
+	require.NoError(t, w.runRetention())
+	require.True(t, w.firstSegment > 0, "retention must reclaim segments even if Truncate is never called")
+
+	protected := w.firstSegment
+	require.NoError(t, w.Truncate(WALPosition{Segment: protected, Offset: 8}))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, w.entry(WALEntrySeries, 1, []byte("0123456789")))
+	}
+	require.NoError(t, w.runRetention())
+	require.True(t, w.firstSegment <= protected, "retention must not delete at or past the low watermark")
+
+	require.NoError(t, w.Close())
+}
+
+// A sealed segment rewritten with compression must still read back
+// identically through WALReader.
+func TestWAL_CompressedSegmentReadback(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "test_wal_compressed_readback")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := OpenWAL(tmpdir, nil, 0, &WALOptions{Compression: WALCompressionSnappy})
+	require.NoError(t, err)
+	w.segmentSize = 4096
+
+	series := []labels.Labels{{{Name: "a", Value: "1"}}}
+	require.NoError(t, w.Log(series, nil))
+	// cut() seals the segment just written to and, with compression
+	// configured, kicks off a background rewrite; Close waits for it.
+	require.NoError(t, w.cut())
+	require.NoError(t, w.Close())
+
+	w2, err := OpenWAL(tmpdir, nil, 0, nil)
+	require.NoError(t, err)
+	defer w2.Close()
+
+	r := w2.Reader()
+	require.True(t, r.Next())
+	lsets, _ := r.At()
+	require.Equal(t, series, lsets)
+	require.NoError(t, r.Err())
+}
+
 // Symmetrical test of reading and writing to the WAL via its main interface.
 func TestWAL_Log_Restore(t *testing.T) {
 	// Generate testing data. It does not make semantical sense but
@@ -135,7 +375,7 @@ func TestWAL_Log_Restore(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	w, err := OpenWAL(dir, nil, 0)
+	w, err := OpenWAL(dir, nil, 0, &WALOptions{MaxSegmentSize: 300 * 1000})
 	require.NoError(t, err)
 
 	// Set smaller segment size so we can actually write several files.
@@ -147,7 +387,7 @@ func TestWAL_Log_Restore(t *testing.T) {
 
 	require.NoError(t, w.Close())
 
-	w, err = OpenWAL(dir, nil, 0)
+	w, err = OpenWAL(dir, nil, 0, nil)
 	r := w.Reader()
 
 	var i, j int